@@ -1,13 +1,10 @@
 package core
 
 import (
-	// "errors"
-	"bytes"
+	"context"
 	"database/sql"
-	"errors"
 	"fmt"
 	"io/ioutil"
-	"net/http"
 	"net/url"
 	"os"
 	"strconv"
@@ -19,6 +16,11 @@ import (
 	"github.com/toorop/tmail/msproto"
 )
 
+// msFireAndForgetMaxDuration is the hard cap put on the detached context used
+// for fireandforget=true calls, so a goroutine never outlives a misbehaving
+// microservice indefinitely.
+const msFireAndForgetMaxDuration = 5 * time.Minute
+
 type onfailure int
 
 // what to do on failure
@@ -35,6 +37,10 @@ type microservice struct {
 	fireAndForget        bool
 	timeout              uint64
 	onFailure            onfailure
+	stream               bool
+	maxBodySize          uint64
+	logLevel             msLogLevel
+	hasLogLevel          bool
 }
 
 // newMicroservice retuns a microservice parsing URI
@@ -44,8 +50,10 @@ func newMicroservice(uri string) (*microservice, error) {
 		onFailure:            CONTINUE,
 		timeout:              30,
 	}
-	t := strings.Split(uri, "?")
-	ms.url = t[0]
+	// ms.url keeps the full uri, query string included: transports that key
+	// behavior off query params (e.g. natsTransport.Call's fireandforget
+	// fast path) parse ms.url again at call time, not this uri.
+	ms.url = uri
 	parsed, err := url.Parse(uri)
 	if err != nil {
 		return nil, err
@@ -73,38 +81,67 @@ func newMicroservice(uri string) (*microservice, error) {
 			ms.onFailure = PERMFAIL
 		}
 	}
-	return ms, nil
-}
 
-// doRequest do request on microservices endpoint
-func (ms *microservice) doRequest(data *[]byte) (*http.Response, error) {
-	req, _ := http.NewRequest("POST", ms.url, bytes.NewBuffer(*data))
-	req.Header.Set("Content-Type", "application/x-protobuf")
-	client := &http.Client{
-		Timeout: time.Duration(ms.timeout) * time.Second,
+	// stream=true switches smtpddata to sending the mail body as a sequence
+	// of protobuf-framed chunks instead of a tempfile+DataLink callback; it
+	// has no effect on the other hooks. maxbodysize bounds it, in bytes.
+	// ws(s)://, grpc:// and nats:// carry a stream of response frames;
+	// http(s):// has no framed-multipart implementation, so reject it
+	// at config time instead of silently falling back to a broken exchange.
+	if parsed.Query().Get("stream") == "true" {
+		if parsed.Scheme == "http" || parsed.Scheme == "https" {
+			return nil, fmt.Errorf("ms %s: stream=true is not supported over %s, use ws(s):// or grpc://", uri, parsed.Scheme)
+		}
+		ms.stream = true
+	}
+	if parsed.Query().Get("maxbodysize") != "" {
+		ms.maxBodySize, err = strconv.ParseUint(parsed.Query().Get("maxbodysize"), 10, 64)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// per-URL log level override; falls back to the global level (see
+	// microservice_log.go) when absent so most operators never need this.
+	if lvl, ok := parseMsLogLevel(parsed.Query().Get("loglevel")); ok {
+		ms.logLevel = lvl
+		ms.hasLogLevel = true
 	}
-	return client.Do(req)
+
+	return ms, nil
 }
 
-// call will call microservice
-func (ms *microservice) call(data *[]byte) (*[]byte, error) {
-	r, err := ms.doRequest(data)
+// call will call microservice. It resolves ms.url's scheme to a registered
+// MicroserviceTransport (see transport.go) and dispatches the call there, so
+// http(s)://, ws(s):// and any third-party scheme share the same call path.
+// ctx bounds the whole call so that callers can cancel it before ms.timeout elapses.
+func (ms *microservice) call(ctx context.Context, data *[]byte) (*[]byte, error) {
+	ctx, cancel := context.WithTimeout(ctx, time.Duration(ms.timeout)*time.Second)
+	defer cancel()
+
+	transport, err := transportFor(ms.url)
 	if err != nil {
 		return nil, err
 	}
-	defer r.Body.Close()
-	// always get returned data
-	rawBody, err := ioutil.ReadAll(r.Body)
+	rawBody, err := transport.Call(ctx, ms.url, *data)
 	if err != nil {
 		return nil, err
 	}
-	// HTTP error handling
-	if r.StatusCode > 399 {
-		return nil, errors.New(r.Status + " - " + string(rawBody))
-	}
 	return &rawBody, nil
 }
 
+// String renders the onfailure action for structured logging.
+func (o onfailure) String() string {
+	switch o {
+	case TEMPFAIL:
+		return "tempfail"
+	case PERMFAIL:
+		return "permfail"
+	default:
+		return "continue"
+	}
+}
+
 // shouldWeStopOnError return if process wich call microserviuce should stop on error
 func (ms *microservice) stopOnError() (stop bool) {
 	switch ms.onFailure {
@@ -154,7 +191,10 @@ func handleSMTPResponse(smtpResponse *msproto.SmtpResponse, s *SMTPServerSession
 
 // msSmtpdNewClient execute microservices for smtpdnewclient hook
 // Warning: error are not returned to client
-func msSmtpdNewClient(s *SMTPServerSession) (stop bool) {
+// ctx is the session-scoped context: it is canceled as soon as the client
+// connection closes, which aborts any in-flight microservice call instead of
+// leaking it until ms.timeout.
+func msSmtpdNewClient(ctx context.Context, s *SMTPServerSession) (stop bool) {
 	if len(Cfg.GetMicroservicesUri("smtpdnewclient")) == 0 {
 		return false
 	}
@@ -182,20 +222,30 @@ func msSmtpdNewClient(s *SMTPServerSession) (stop bool) {
 		}
 
 		// call ms
-		s.log("calling " + ms.url)
+		fields := msCallFields{Hook: "smtpdnewclient", SessionID: s.uuid, OnFailureAction: ms.onFailure.String()}
+		ms.logCall(msLogDebug, fields, "calling microservice")
 		if ms.fireAndForget {
-			go ms.call(&msg)
+			go func(ms *microservice, msg []byte) {
+				fctx, cancel := context.WithTimeout(context.Background(), msFireAndForgetMaxDuration)
+				defer cancel()
+				ms.call(fctx, &msg)
+			}(ms, msg)
+
 			continue
 		}
 
-		response, err := ms.call(&msg)
+		start := time.Now()
+		response, err := ms.call(ctx, &msg)
+		fields.DurationMs = time.Since(start).Milliseconds()
 		if err != nil {
+			ms.logCall(msLogError, fields, "call failed. "+err.Error())
 			s.logError("microservice " + ms.url + " failed. " + err.Error())
 			if ms.stopOnError() {
 				return
 			}
 			continue
 		}
+		ms.logCall(msLogInfo, fields, "call succeeded")
 
 		// parse resp
 		msResponse := &msproto.SmtpdNewClientResponse{}
@@ -223,7 +273,8 @@ func msSmtpdNewClient(s *SMTPServerSession) (stop bool) {
 }
 
 // msSmtpdRcptToRelayIsGranted check if relay is granted by using rcpt to
-func msSmtpdRcptTo(s *SMTPServerSession, rcptTo string) (stop bool) {
+// ctx is the session-scoped context propagated from the SMTP command handler.
+func msSmtpdRcptTo(ctx context.Context, s *SMTPServerSession, rcptTo string) (stop bool) {
 	if len(Cfg.GetMicroservicesUri("smtpdrcptto")) == 0 {
 		return false
 	}
@@ -249,19 +300,28 @@ func msSmtpdRcptTo(s *SMTPServerSession, rcptTo string) (stop bool) {
 		}
 
 		// call ms
-		s.log("calling " + ms.url)
+		fields := msCallFields{Hook: "smtpdrcptto", SessionID: s.uuid, OnFailureAction: ms.onFailure.String()}
+		ms.logCall(msLogDebug, fields, "calling microservice")
 		if ms.fireAndForget {
-			go ms.call(&msg)
+			go func(ms *microservice, msg []byte) {
+				fctx, cancel := context.WithTimeout(context.Background(), msFireAndForgetMaxDuration)
+				defer cancel()
+				ms.call(fctx, &msg)
+			}(ms, msg)
 			continue
 		}
 
-		response, err := ms.call(&msg)
+		start := time.Now()
+		response, err := ms.call(ctx, &msg)
+		fields.DurationMs = time.Since(start).Milliseconds()
 		if err != nil {
+			ms.logCall(msLogError, fields, "call failed. "+err.Error())
 			if stop := ms.handleSMTPError(err, s); stop {
 				return true
 			}
 			continue
 		}
+		ms.logCall(msLogInfo, fields, "call succeeded")
 
 		// parse resp
 		msResponse := &msproto.SmtpdRcptToResponse{}
@@ -292,44 +352,24 @@ func msSmtpdRcptTo(s *SMTPServerSession, rcptTo string) (stop bool) {
 }
 
 // smtpdData executes microservices for the smtpdData hook
-func smtpdData(s *SMTPServerSession, rawMail *[]byte) (stop bool, extraHeaders *[]string) {
+// ctx is the session-scoped context propagated from the SMTP command handler.
+func smtpdData(ctx context.Context, s *SMTPServerSession, rawMail *[]byte) (stop bool, extraHeaders *[]string) {
 	extraHeaders = &[]string{}
 	if len(Cfg.GetMicroservicesUri("smtpddata")) == 0 {
 		return false, extraHeaders
 	}
 
-	// save data to server throught HTTP
-	f, err := ioutil.TempFile(Cfg.GetTempDir(), "")
-	if err != nil {
-		s.logError("ms - unable to save rawmail in tempfile. " + err.Error())
-		return false, extraHeaders
-	}
-	if _, err = f.Write(*rawMail); err != nil {
-		s.logError("ms - unable to save rawmail in tempfile. " + err.Error())
-		return false, extraHeaders
-	}
-	defer os.Remove(f.Name())
-
-	// HTTP link
-	t := strings.Split(f.Name(), "/")
-	link := fmt.Sprintf("%s:%d/msdata/%s", Cfg.GetRestServerIp(), Cfg.GetRestServerPort(), t[len(t)-1])
-
-	// TLS
-	if Cfg.GetRestServerIsTls() {
-		link = "https://" + link
-	} else {
-		link = "http://" + link
-	}
-
-	// serialize data
-	msg, err := proto.Marshal(&msproto.SmtpdDataQuery{
-		SessionId: proto.String(s.uuid),
-		DataLink:  proto.String(link),
-	})
-	if err != nil {
-		s.logError("unable to serialize data as SmtpdDataQuery. " + err.Error())
-		return
-	}
+	// tempfile+link message, built lazily: only needed if at least one
+	// microservice still uses the default (non-streaming) mode. The
+	// tempfile must outlive the whole loop, since several non-streaming
+	// microservices may fetch it one after another.
+	var linkMsg []byte
+	var tempFilePath string
+	defer func() {
+		if tempFilePath != "" {
+			os.Remove(tempFilePath)
+		}
+	}()
 
 	for _, uri := range Cfg.GetMicroservicesUri("smtpddata") {
 		// parse uri
@@ -342,9 +382,25 @@ func smtpdData(s *SMTPServerSession, rawMail *[]byte) (stop bool, extraHeaders *
 			continue
 		}
 
-		s.log("calling " + ms.url)
-		response, err := ms.call(&msg)
+		fields := msCallFields{Hook: "smtpddata", SessionID: s.uuid, OnFailureAction: ms.onFailure.String()}
+		ms.logCall(msLogDebug, fields, "calling microservice")
+
+		var response *[]byte
+		start := time.Now()
+		if ms.stream {
+			response, err = ms.callDataStream(ctx, s.uuid, rawMail)
+		} else {
+			if linkMsg == nil {
+				linkMsg, tempFilePath, err = smtpdDataLinkMsg(s, rawMail)
+				if err != nil {
+					return
+				}
+			}
+			response, err = ms.call(ctx, &linkMsg)
+		}
+		fields.DurationMs = time.Since(start).Milliseconds()
 		if err != nil {
+			ms.logCall(msLogError, fields, "call failed. "+err.Error())
 			if stop := ms.handleSMTPError(err, s); stop {
 				return true, extraHeaders
 			}
@@ -360,6 +416,7 @@ func smtpdData(s *SMTPServerSession, rawMail *[]byte) (stop bool, extraHeaders *
 			}
 			continue
 		}
+		ms.logCall(msLogInfo, fields, "call succeeded")
 
 		*extraHeaders = append(*extraHeaders, msResponse.GetExtraHeaders()...)
 
@@ -377,8 +434,48 @@ func smtpdData(s *SMTPServerSession, rawMail *[]byte) (stop bool, extraHeaders *
 	return false, extraHeaders
 }
 
+// smtpdDataLinkMsg builds the legacy SmtpdDataQuery: rawMail is saved to a
+// tempfile and the microservice is handed a DataLink back into tmail's REST
+// server to fetch it. The caller is responsible for removing the returned
+// tempFilePath once every non-streaming microservice has been called.
+func smtpdDataLinkMsg(s *SMTPServerSession, rawMail *[]byte) (msg []byte, tempFilePath string, err error) {
+	f, err := ioutil.TempFile(Cfg.GetTempDir(), "")
+	if err != nil {
+		s.logError("ms - unable to save rawmail in tempfile. " + err.Error())
+		return nil, "", err
+	}
+	tempFilePath = f.Name()
+	if _, err = f.Write(*rawMail); err != nil {
+		s.logError("ms - unable to save rawmail in tempfile. " + err.Error())
+		return nil, tempFilePath, err
+	}
+
+	// HTTP link
+	t := strings.Split(tempFilePath, "/")
+	link := fmt.Sprintf("%s:%d/msdata/%s", Cfg.GetRestServerIp(), Cfg.GetRestServerPort(), t[len(t)-1])
+
+	// TLS
+	if Cfg.GetRestServerIsTls() {
+		link = "https://" + link
+	} else {
+		link = "http://" + link
+	}
+
+	msg, err = proto.Marshal(&msproto.SmtpdDataQuery{
+		SessionId: proto.String(s.uuid),
+		DataLink:  proto.String(link),
+	})
+	if err != nil {
+		s.logError("unable to serialize data as SmtpdDataQuery. " + err.Error())
+		return nil, tempFilePath, err
+	}
+	return msg, tempFilePath, nil
+}
+
 // msGetRoutesmsGetRoutes returns routes from microservices
-func msGetRoutes(d *delivery) (routes *[]Route, stop bool) {
+// ctx is expected to be canceled when deliverd is shutting down, so the call
+// is aborted immediately rather than blocking for up to ms.timeout.
+func msGetRoutes(ctx context.Context, d *delivery) (routes *[]Route, stop bool) {
 	stop = false
 	r := []Route{}
 	routes = &r
@@ -402,12 +499,16 @@ func msGetRoutes(d *delivery) (routes *[]Route, stop bool) {
 		Log.Error(fmt.Sprintf("deliverd-remote %s - msGetRoutes - unable to init new ms: %s", d.id, err.Error()))
 		return nil, ms.stopOnError()
 	}
-	Log.Info(fmt.Sprintf("deliverd-remote %s - msGetRoutes - call ms: %s", d.id, ms.url))
-	response, err := ms.call(&msg)
+	fields := msCallFields{Hook: "deliverdgetroutes", SessionID: d.id, OnFailureAction: ms.onFailure.String()}
+	ms.logCall(msLogDebug, fields, "calling microservice")
+	start := time.Now()
+	response, err := ms.call(ctx, &msg)
+	fields.DurationMs = time.Since(start).Milliseconds()
 	if err != nil {
-		Log.Error(fmt.Sprintf("deliverd-remote %s - msGetRoutes - unable to call ms: %s", d.id, err.Error()))
+		ms.logCall(msLogError, fields, "call failed. "+err.Error())
 		return nil, ms.stopOnError()
 	}
+	ms.logCall(msLogInfo, fields, "call succeeded")
 
 	// parse resp
 	msResponse := &msproto.DeliverdGetRoutesResponse{}
@@ -0,0 +1,109 @@
+package core
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+
+	"github.com/toorop/tmail/msproto"
+)
+
+// dataChunkSize is the size, in bytes, of each protobuf-framed chunk the mail
+// body is cut into for a streaming smtpddata microservice. This file depends
+// on msproto.proto defining SmtpdDataChunk (session_id, data, last) and
+// msproto being regenerated from it.
+const dataChunkSize = 64 * 1024
+
+// callDataStream sends rawMail as a sequence of length-prefixed
+// msproto.SmtpdDataChunk frames instead of the tempfile+DataLink callback,
+// and merges every msproto.SmtpdDataResponse frame the microservice streams
+// back into a single response so the rest of smtpdData doesn't need to know
+// the call was streamed. ctx is bounded by ms.timeout here, same as call(),
+// so a stalled streaming microservice can't block smtpdData past it.
+func (ms *microservice) callDataStream(ctx context.Context, sessionID string, rawMail *[]byte) (*[]byte, error) {
+	ctx, cancel := context.WithTimeout(ctx, time.Duration(ms.timeout)*time.Second)
+	defer cancel()
+
+	if ms.maxBodySize > 0 && uint64(len(*rawMail)) > ms.maxBodySize {
+		return nil, fmt.Errorf("ms-stream %s: mail body of %d bytes exceeds maxbodysize %d", ms.url, len(*rawMail), ms.maxBodySize)
+	}
+
+	payload, err := buildDataChunks(sessionID, *rawMail)
+	if err != nil {
+		return nil, err
+	}
+
+	transport, err := transportFor(ms.url)
+	if err != nil {
+		return nil, err
+	}
+	chunks, err := transport.Stream(ctx, ms.url, payload)
+	if err != nil {
+		return nil, err
+	}
+
+	merged := &msproto.SmtpdDataResponse{}
+	for chunk := range chunks {
+		resp := &msproto.SmtpdDataResponse{}
+		if err := proto.Unmarshal(chunk, resp); err != nil {
+			return nil, fmt.Errorf("ms-stream %s: unable to unmarshal response frame. %s", ms.url, err.Error())
+		}
+		merged.ExtraHeaders = append(merged.ExtraHeaders, resp.GetExtraHeaders()...)
+		if resp.GetSmtpResponse() != nil {
+			merged.SmtpResponse = resp.SmtpResponse
+		}
+		if resp.GetDropConnection() {
+			merged.DropConnection = resp.DropConnection
+		}
+	}
+
+	// A ctx timeout/cancel mid-stream makes the transport close chunks early,
+	// which ends the range above same as a clean end-of-stream would; check
+	// ctx explicitly so a stalled/canceled microservice is reported as the
+	// failure it is instead of a successful (likely partial) response.
+	if err := ctx.Err(); err != nil {
+		return nil, fmt.Errorf("ms-stream %s: %s", ms.url, err)
+	}
+
+	rawBody, err := proto.Marshal(merged)
+	if err != nil {
+		return nil, err
+	}
+	return &rawBody, nil
+}
+
+// buildDataChunks cuts rawMail into dataChunkSize-sized msproto.SmtpdDataChunk
+// messages, each framed with a 4-byte big-endian length prefix so the
+// receiving side can read them off a single request body or socket.
+func buildDataChunks(sessionID string, rawMail []byte) ([]byte, error) {
+	var framed []byte
+	for offset := 0; offset < len(rawMail) || offset == 0; offset += dataChunkSize {
+		end := offset + dataChunkSize
+		if end > len(rawMail) {
+			end = len(rawMail)
+		}
+		last := end == len(rawMail)
+
+		chunk, err := proto.Marshal(&msproto.SmtpdDataChunk{
+			SessionId: proto.String(sessionID),
+			Data:      rawMail[offset:end],
+			Last:      proto.Bool(last),
+		})
+		if err != nil {
+			return nil, fmt.Errorf("unable to serialize SmtpdDataChunk. %s", err.Error())
+		}
+
+		header := make([]byte, 4)
+		binary.BigEndian.PutUint32(header, uint32(len(chunk)))
+		framed = append(framed, header...)
+		framed = append(framed, chunk...)
+
+		if last {
+			break
+		}
+	}
+	return framed, nil
+}
@@ -0,0 +1,97 @@
+package core
+
+import (
+	"encoding/binary"
+	"testing"
+
+	"github.com/golang/protobuf/proto"
+
+	"github.com/toorop/tmail/msproto"
+)
+
+// decodeDataChunks reverses buildDataChunks, for asserting on its output.
+func decodeDataChunks(t *testing.T, framed []byte) []*msproto.SmtpdDataChunk {
+	t.Helper()
+	var chunks []*msproto.SmtpdDataChunk
+	for offset := 0; offset < len(framed); {
+		if offset+4 > len(framed) {
+			t.Fatalf("decodeDataChunks: truncated length prefix at offset %d", offset)
+		}
+		length := binary.BigEndian.Uint32(framed[offset : offset+4])
+		offset += 4
+		if offset+int(length) > len(framed) {
+			t.Fatalf("decodeDataChunks: frame at offset %d overruns buffer", offset)
+		}
+		chunk := &msproto.SmtpdDataChunk{}
+		if err := proto.Unmarshal(framed[offset:offset+int(length)], chunk); err != nil {
+			t.Fatalf("decodeDataChunks: unable to unmarshal chunk. %s", err.Error())
+		}
+		chunks = append(chunks, chunk)
+		offset += int(length)
+	}
+	return chunks
+}
+
+func TestBuildDataChunksEmptyBody(t *testing.T) {
+	framed, err := buildDataChunks("sess-1", nil)
+	if err != nil {
+		t.Fatalf("buildDataChunks: %s", err.Error())
+	}
+	chunks := decodeDataChunks(t, framed)
+	if len(chunks) != 1 {
+		t.Fatalf("buildDataChunks: expected a single chunk for an empty body, got %d", len(chunks))
+	}
+	if len(chunks[0].GetData()) != 0 || !chunks[0].GetLast() {
+		t.Fatalf("buildDataChunks: expected one empty, last chunk, got data=%q last=%v", chunks[0].GetData(), chunks[0].GetLast())
+	}
+}
+
+func TestBuildDataChunksExactMultiple(t *testing.T) {
+	rawMail := make([]byte, dataChunkSize*2)
+	for i := range rawMail {
+		rawMail[i] = byte(i)
+	}
+	framed, err := buildDataChunks("sess-2", rawMail)
+	if err != nil {
+		t.Fatalf("buildDataChunks: %s", err.Error())
+	}
+	chunks := decodeDataChunks(t, framed)
+	if len(chunks) != 2 {
+		t.Fatalf("buildDataChunks: expected 2 chunks for an exact multiple of dataChunkSize, got %d", len(chunks))
+	}
+	for i, chunk := range chunks {
+		last := i == len(chunks)-1
+		if chunk.GetLast() != last {
+			t.Fatalf("buildDataChunks: chunk %d last=%v, want %v", i, chunk.GetLast(), last)
+		}
+		if len(chunk.GetData()) != dataChunkSize {
+			t.Fatalf("buildDataChunks: chunk %d has %d bytes, want %d", i, len(chunk.GetData()), dataChunkSize)
+		}
+	}
+}
+
+func TestBuildDataChunksPartialLastChunk(t *testing.T) {
+	rawMail := make([]byte, dataChunkSize+10)
+	framed, err := buildDataChunks("sess-3", rawMail)
+	if err != nil {
+		t.Fatalf("buildDataChunks: %s", err.Error())
+	}
+	chunks := decodeDataChunks(t, framed)
+	if len(chunks) != 2 {
+		t.Fatalf("buildDataChunks: expected 2 chunks, got %d", len(chunks))
+	}
+	if chunks[0].GetLast() {
+		t.Fatalf("buildDataChunks: first chunk should not be marked last")
+	}
+	if !chunks[1].GetLast() {
+		t.Fatalf("buildDataChunks: second chunk should be marked last")
+	}
+	if len(chunks[1].GetData()) != 10 {
+		t.Fatalf("buildDataChunks: last chunk has %d bytes, want 10", len(chunks[1].GetData()))
+	}
+	for _, chunk := range chunks {
+		if chunk.GetSessionId() != "sess-3" {
+			t.Fatalf("buildDataChunks: chunk session_id=%q, want sess-3", chunk.GetSessionId())
+		}
+	}
+}
@@ -0,0 +1,142 @@
+package core
+
+import (
+	"fmt"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+)
+
+// msLogLevel is the verbosity of a single microservice call's logging.
+type msLogLevel int32
+
+const (
+	msLogTrace msLogLevel = iota
+	msLogDebug
+	msLogInfo
+	msLogWarn
+	msLogError
+)
+
+// msGlobalLogLevel is the effective level for microservices that don't set
+// their own ?loglevel=. It is read with atomic.LoadInt32 on every call so a
+// SIGHUP-triggered reload (see InitMsLogging) takes effect immediately,
+// without restarting tmail.
+var msGlobalLogLevel int32 = int32(msLogInfo)
+
+// msGlobalLogLevelOnce makes the first read of Cfg.GetMsLogLevel() lazy,
+// rather than happening at package-init time: init() runs at import, before
+// main (or TestMain) has populated Cfg, so reading it there would nil-deref
+// on import alone.
+var msGlobalLogLevelOnce sync.Once
+
+// InitMsLogging wires up SIGHUP-triggered reload of the microservice log
+// level. Call it once from tmail's startup, after Cfg is populated; calls to
+// logCall before that still work, they just resolve the level lazily on
+// first use instead of picking it up from config any earlier.
+func InitMsLogging() {
+	resolveMsGlobalLogLevel()
+
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		for range hup {
+			reloadMsGlobalLogLevel()
+		}
+	}()
+}
+
+// resolveMsGlobalLogLevel reads the microservice log level from config on
+// first call only; later calls are a no-op, since InitMsLogging's SIGHUP
+// handler (if running) is what keeps it current from then on.
+func resolveMsGlobalLogLevel() {
+	msGlobalLogLevelOnce.Do(reloadMsGlobalLogLevel)
+}
+
+// reloadMsGlobalLogLevel re-reads the microservice log level from config.
+func reloadMsGlobalLogLevel() {
+	level, ok := parseMsLogLevel(Cfg.GetMsLogLevel())
+	if !ok {
+		level = msLogInfo
+	}
+	atomic.StoreInt32(&msGlobalLogLevel, int32(level))
+}
+
+// parseMsLogLevel parses a ?loglevel= value (or config value); ok is false
+// and level is meaningless if s isn't a recognized level name.
+func parseMsLogLevel(s string) (level msLogLevel, ok bool) {
+	switch strings.ToLower(s) {
+	case "trace":
+		return msLogTrace, true
+	case "debug":
+		return msLogDebug, true
+	case "info":
+		return msLogInfo, true
+	case "warn", "warning":
+		return msLogWarn, true
+	case "error":
+		return msLogError, true
+	}
+	return msLogInfo, false
+}
+
+func (l msLogLevel) String() string {
+	switch l {
+	case msLogTrace:
+		return "TRACE"
+	case msLogDebug:
+		return "DEBUG"
+	case msLogInfo:
+		return "INFO"
+	case msLogWarn:
+		return "WARN"
+	case msLogError:
+		return "ERROR"
+	default:
+		return "INFO"
+	}
+}
+
+// effectiveLogLevel returns ms's own ?loglevel= override if set, otherwise
+// the current global level.
+func (ms *microservice) effectiveLogLevel() msLogLevel {
+	if ms.hasLogLevel {
+		return ms.logLevel
+	}
+	resolveMsGlobalLogLevel()
+	return msLogLevel(atomic.LoadInt32(&msGlobalLogLevel))
+}
+
+// msCallFields are the structured key/value fields emitted for every
+// microservice call, so operators can filter logs by microservice or
+// session without regex-scraping free-form strings. There is no status_code
+// field: it's an HTTP-only concept and the transport abstraction (see
+// transport.go) deliberately hides per-scheme details from the call sites
+// that build these fields, so a field that's always 0 for ws(s)/grpc/nats
+// and was never wired up for http(s) either would be actively misleading.
+type msCallFields struct {
+	Hook            string
+	SessionID       string
+	DurationMs      int64
+	OnFailureAction string
+}
+
+// logCall emits msg with f's structured fields if level is at or above ms's
+// effective log level. The level itself is included as a field so WARN and
+// ERROR lines stay distinguishable even though Log only exposes Info/Error.
+func (ms *microservice) logCall(level msLogLevel, f msCallFields, msg string) {
+	if level < ms.effectiveLogLevel() {
+		return
+	}
+	line := fmt.Sprintf("level=%s ms_url=%s hook=%s session_id=%s duration_ms=%d onfailure_action=%s - %s",
+		level, ms.url, f.Hook, f.SessionID, f.DurationMs, f.OnFailureAction, msg)
+	switch level {
+	case msLogError:
+		Log.Error(line)
+	default:
+		Log.Info(line)
+	}
+}
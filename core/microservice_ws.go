@@ -0,0 +1,361 @@
+package core
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// frame types used on the mux-grid wire format
+const (
+	wsFrameRequest byte = iota
+	wsFrameResponse
+	wsFrameCancel
+)
+
+// wsHeaderSize is the size in bytes of the frame header: mux id (4) + type (1) + length (4)
+const wsHeaderSize = 9
+
+// wsReconnectMinDelay / wsReconnectMaxDelay bound the reconnect backoff
+const (
+	wsReconnectMinDelay = 500 * time.Millisecond
+	wsReconnectMaxDelay = 30 * time.Second
+)
+
+// wsPending is a request awaiting its response frame(s). chunkCh is only set
+// for streaming requests: every response frame is forwarded to it until a
+// zero-length frame marks the end of the stream. readLoop is the only
+// goroutine that ever sends on or closes chunkCh, so no locking is needed
+// around it; stream() never touches chunkCh directly, it forwards through an
+// out channel of its own so it can stop early on ctx cancellation without
+// racing readLoop's close. done is closed by dropPending; readLoop selects on
+// it alongside the chunkCh send so a stream whose consumer walked away
+// (ctx canceled, chunkCh's buffer full) can't wedge readLoop, which serves
+// every other muxed request on the same connection.
+type wsPending struct {
+	respCh  chan []byte
+	errCh   chan error
+	chunkCh chan []byte
+	done    chan struct{}
+}
+
+// wsConn is a single long-lived, multiplexed connection to a ws(s):// microservice endpoint.
+// Many concurrent calls share the same socket, each identified by a mux id.
+type wsConn struct {
+	url string
+
+	mu      sync.Mutex
+	conn    *websocket.Conn
+	pending map[uint32]*wsPending
+	nextID  uint32
+	closed  bool
+}
+
+// wsPool keeps one wsConn per microservice URL so hook calls reuse the same socket.
+var wsPool = struct {
+	sync.Mutex
+	conns map[string]*wsConn
+}{conns: map[string]*wsConn{}}
+
+// getWSConn returns the pooled connection for url, dialing it if needed. The
+// pool lock is held across the miss->dial->store sequence so two concurrent
+// first-use callers for the same url can't both dial and both start a
+// readLoop, which would leak one of the sockets and its goroutine forever.
+func getWSConn(url string) (*wsConn, error) {
+	wsPool.Lock()
+	defer wsPool.Unlock()
+
+	if c, ok := wsPool.conns[url]; ok {
+		return c, nil
+	}
+
+	c := &wsConn{
+		url:     url,
+		pending: map[uint32]*wsPending{},
+	}
+	if err := c.dial(); err != nil {
+		return nil, err
+	}
+
+	wsPool.conns[url] = c
+	go c.readLoop()
+	return c, nil
+}
+
+// dial opens (or reopens) the underlying websocket connection.
+func (c *wsConn) dial() error {
+	conn, _, err := websocket.DefaultDialer.Dial(c.url, nil)
+	if err != nil {
+		return fmt.Errorf("ms-ws %s: unable to dial. %s", c.url, err.Error())
+	}
+	c.mu.Lock()
+	c.conn = conn
+	c.closed = false
+	c.mu.Unlock()
+	return nil
+}
+
+// call sends data as a single request frame and blocks until the matching response
+// frame arrives or ctx is done. A cancel control frame is sent so the microservice
+// can abandon the in-flight request as soon as ctx's deadline or cancellation fires.
+func (c *wsConn) call(ctx context.Context, data []byte) ([]byte, error) {
+	c.mu.Lock()
+	if c.closed {
+		c.mu.Unlock()
+		return nil, errors.New("ms-ws " + c.url + ": connection is closed")
+	}
+	c.nextID++
+	muxID := c.nextID
+	p := &wsPending{respCh: make(chan []byte, 1), errCh: make(chan error, 1), done: make(chan struct{})}
+	c.pending[muxID] = p
+	c.mu.Unlock()
+
+	if err := c.writeFrame(muxID, wsFrameRequest, data); err != nil {
+		c.dropPending(muxID)
+		return nil, err
+	}
+
+	select {
+	case resp := <-p.respCh:
+		return resp, nil
+	case err := <-p.errCh:
+		return nil, err
+	case <-ctx.Done():
+		c.writeFrame(muxID, wsFrameCancel, nil)
+		c.dropPending(muxID)
+		return nil, fmt.Errorf("ms-ws %s: %s", c.url, ctx.Err())
+	}
+}
+
+// stream sends data as a single request frame and returns a channel fed with
+// every response frame carrying the request's mux id. The channel is closed
+// when the microservice sends a zero-length response frame, ctx is done, or
+// the connection drops.
+func (c *wsConn) stream(ctx context.Context, data []byte) (<-chan []byte, error) {
+	c.mu.Lock()
+	if c.closed {
+		c.mu.Unlock()
+		return nil, errors.New("ms-ws " + c.url + ": connection is closed")
+	}
+	c.nextID++
+	muxID := c.nextID
+	p := &wsPending{errCh: make(chan error, 1), chunkCh: make(chan []byte, 16), done: make(chan struct{})}
+	c.pending[muxID] = p
+	c.mu.Unlock()
+
+	if err := c.writeFrame(muxID, wsFrameRequest, data); err != nil {
+		c.dropPending(muxID)
+		return nil, err
+	}
+
+	// out is owned by this goroutine alone, so it can stop forwarding and
+	// close it the moment ctx is done without racing readLoop, which keeps
+	// sending to and eventually closes p.chunkCh on its own.
+	out := make(chan []byte, 16)
+	go func() {
+		defer close(out)
+		for {
+			select {
+			case b, ok := <-p.chunkCh:
+				if !ok {
+					return
+				}
+				select {
+				case out <- b:
+				case <-ctx.Done():
+					c.writeFrame(muxID, wsFrameCancel, nil)
+					c.dropPending(muxID)
+					return
+				}
+			case <-ctx.Done():
+				c.writeFrame(muxID, wsFrameCancel, nil)
+				c.dropPending(muxID)
+				return
+			case <-p.errCh:
+				// readLoop already dropped the pending entry and closed chunkCh
+				return
+			}
+		}
+	}()
+
+	return out, nil
+}
+
+// dropPending removes muxID's pending entry and closes its done channel, so
+// a readLoop that's mid-send to it (chunkCh) stops waiting on the buffer.
+func (c *wsConn) dropPending(muxID uint32) {
+	c.mu.Lock()
+	p := c.pending[muxID]
+	delete(c.pending, muxID)
+	c.mu.Unlock()
+	if p != nil {
+		close(p.done)
+	}
+}
+
+// writeFrame writes a single mux frame: [muxID uint32][type byte][length uint32][payload]
+func (c *wsConn) writeFrame(muxID uint32, typ byte, payload []byte) error {
+	header := make([]byte, wsHeaderSize)
+	binary.BigEndian.PutUint32(header[0:4], muxID)
+	header[4] = typ
+	binary.BigEndian.PutUint32(header[5:9], uint32(len(payload)))
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed || c.conn == nil {
+		return errors.New("ms-ws " + c.url + ": connection is closed")
+	}
+	if err := c.conn.WriteMessage(websocket.BinaryMessage, append(header, payload...)); err != nil {
+		return fmt.Errorf("ms-ws %s: write failed. %s", c.url, err.Error())
+	}
+	return nil
+}
+
+// readLoop dispatches incoming response frames to their waiting caller, and
+// reconnects with backoff when the socket drops.
+func (c *wsConn) readLoop() {
+	delay := wsReconnectMinDelay
+	for {
+		c.mu.Lock()
+		conn := c.conn
+		c.mu.Unlock()
+		if conn == nil {
+			return
+		}
+
+		_, msg, err := conn.ReadMessage()
+		if err != nil {
+			Log.Error(fmt.Sprintf("ms-ws %s: connection lost. %s", c.url, err.Error()))
+			c.failAllPending(err)
+
+			time.Sleep(delay)
+			if err := c.dial(); err != nil {
+				Log.Error(fmt.Sprintf("ms-ws %s: reconnect failed. %s", c.url, err.Error()))
+				delay *= 2
+				if delay > wsReconnectMaxDelay {
+					delay = wsReconnectMaxDelay
+				}
+				continue
+			}
+			delay = wsReconnectMinDelay
+			continue
+		}
+
+		muxID, typ, payload, ok := parseWSFrame(msg)
+		if !ok {
+			continue
+		}
+		c.dispatchFrame(muxID, typ, payload)
+	}
+}
+
+// parseWSFrame decodes a raw websocket message into its mux header fields.
+// ok is false if msg is too short or its length prefix overruns msg, in
+// which case muxID/typ/payload are meaningless and the frame must be dropped.
+func parseWSFrame(msg []byte) (muxID uint32, typ byte, payload []byte, ok bool) {
+	if len(msg) < wsHeaderSize {
+		return 0, 0, nil, false
+	}
+	muxID = binary.BigEndian.Uint32(msg[0:4])
+	typ = msg[4]
+	length := binary.BigEndian.Uint32(msg[5:9])
+	if int(length) > len(msg)-wsHeaderSize {
+		return 0, 0, nil, false
+	}
+	return muxID, typ, msg[wsHeaderSize : wsHeaderSize+int(length)], true
+}
+
+// dispatchFrame routes a decoded response frame to muxID's pending request,
+// if any is still waiting for one.
+func (c *wsConn) dispatchFrame(muxID uint32, typ byte, payload []byte) {
+	if typ != wsFrameResponse {
+		c.mu.Lock()
+		p := c.pending[muxID]
+		delete(c.pending, muxID)
+		c.mu.Unlock()
+		if p != nil {
+			p.errCh <- fmt.Errorf("ms-ws %s: unexpected frame type %d", c.url, typ)
+			if p.chunkCh != nil {
+				close(p.chunkCh)
+			}
+		}
+		return
+	}
+
+	c.mu.Lock()
+	p := c.pending[muxID]
+	if p != nil && p.chunkCh == nil {
+		// single-response request: done as soon as the response arrives
+		delete(c.pending, muxID)
+	}
+	c.mu.Unlock()
+	if p == nil {
+		return
+	}
+
+	if p.chunkCh == nil {
+		p.respCh <- payload
+		return
+	}
+
+	// streaming request: a zero-length frame marks the end of the stream
+	if len(payload) == 0 {
+		c.mu.Lock()
+		delete(c.pending, muxID)
+		c.mu.Unlock()
+		close(p.chunkCh)
+		return
+	}
+	select {
+	case p.chunkCh <- payload:
+	case <-p.done:
+		// consumer already walked away (ctx canceled, dropPending ran):
+		// drop the frame instead of blocking readLoop, which serves
+		// every other muxed request on this connection.
+	}
+}
+
+// failAllPending cancels every in-flight request when the socket drops.
+func (c *wsConn) failAllPending(cause error) {
+	c.mu.Lock()
+	c.closed = true
+	pending := c.pending
+	c.pending = map[uint32]*wsPending{}
+	c.mu.Unlock()
+
+	for _, p := range pending {
+		p.errCh <- fmt.Errorf("ms-ws %s: connection dropped. %s", c.url, cause.Error())
+		if p.chunkCh != nil {
+			close(p.chunkCh)
+		}
+	}
+}
+
+// wsTransport is the MicroserviceTransport for ws:// and wss:// endpoints: a
+// pooled, persistent multiplexed connection per URL instead of a fresh
+// TCP/TLS connection per call.
+type wsTransport struct{}
+
+func (wsTransport) Call(ctx context.Context, rawURL string, payload []byte) ([]byte, error) {
+	c, err := getWSConn(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	return c.call(ctx, payload)
+}
+
+// Stream sends one request frame and streams back every response frame
+// carrying the same mux id until the microservice closes it out with a
+// zero-length response frame.
+func (wsTransport) Stream(ctx context.Context, rawURL string, payload []byte) (<-chan []byte, error) {
+	c, err := getWSConn(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	return c.stream(ctx, payload)
+}
@@ -0,0 +1,95 @@
+package core
+
+import (
+	"encoding/binary"
+	"testing"
+)
+
+func buildWSFrame(muxID uint32, typ byte, payload []byte) []byte {
+	header := make([]byte, wsHeaderSize)
+	binary.BigEndian.PutUint32(header[0:4], muxID)
+	header[4] = typ
+	binary.BigEndian.PutUint32(header[5:9], uint32(len(payload)))
+	return append(header, payload...)
+}
+
+func TestParseWSFrame(t *testing.T) {
+	msg := buildWSFrame(42, wsFrameResponse, []byte("hello"))
+	muxID, typ, payload, ok := parseWSFrame(msg)
+	if !ok {
+		t.Fatalf("parseWSFrame: expected ok, got false")
+	}
+	if muxID != 42 || typ != wsFrameResponse || string(payload) != "hello" {
+		t.Fatalf("parseWSFrame: got muxID=%d typ=%d payload=%q", muxID, typ, payload)
+	}
+}
+
+func TestParseWSFrameTooShort(t *testing.T) {
+	if _, _, _, ok := parseWSFrame([]byte{1, 2, 3}); ok {
+		t.Fatalf("parseWSFrame: expected ok=false for a message shorter than the header")
+	}
+}
+
+func TestParseWSFrameLengthOverrun(t *testing.T) {
+	msg := buildWSFrame(1, wsFrameResponse, nil)
+	binary.BigEndian.PutUint32(msg[5:9], 100)
+	if _, _, _, ok := parseWSFrame(msg); ok {
+		t.Fatalf("parseWSFrame: expected ok=false when length prefix overruns the message")
+	}
+}
+
+func TestDispatchFrameSingleResponse(t *testing.T) {
+	c := &wsConn{pending: map[uint32]*wsPending{}}
+	p := &wsPending{respCh: make(chan []byte, 1), errCh: make(chan error, 1), done: make(chan struct{})}
+	c.pending[1] = p
+
+	c.dispatchFrame(1, wsFrameResponse, []byte("pong"))
+
+	select {
+	case resp := <-p.respCh:
+		if string(resp) != "pong" {
+			t.Fatalf("dispatchFrame: got response %q", resp)
+		}
+	default:
+		t.Fatalf("dispatchFrame: expected a response on respCh")
+	}
+	if _, ok := c.pending[1]; ok {
+		t.Fatalf("dispatchFrame: expected the single-response pending entry to be removed")
+	}
+}
+
+func TestDispatchFrameStreamEnd(t *testing.T) {
+	c := &wsConn{pending: map[uint32]*wsPending{}}
+	p := &wsPending{errCh: make(chan error, 1), chunkCh: make(chan []byte, 16), done: make(chan struct{})}
+	c.pending[2] = p
+
+	c.dispatchFrame(2, wsFrameResponse, []byte("chunk-1"))
+	c.dispatchFrame(2, wsFrameResponse, nil)
+
+	if chunk := <-p.chunkCh; string(chunk) != "chunk-1" {
+		t.Fatalf("dispatchFrame: got chunk %q", chunk)
+	}
+	if _, ok := <-p.chunkCh; ok {
+		t.Fatalf("dispatchFrame: expected chunkCh to be closed after a zero-length frame")
+	}
+	if _, ok := c.pending[2]; ok {
+		t.Fatalf("dispatchFrame: expected the streaming pending entry to be removed once closed")
+	}
+}
+
+func TestDispatchFrameUnexpectedType(t *testing.T) {
+	c := &wsConn{pending: map[uint32]*wsPending{}}
+	p := &wsPending{respCh: make(chan []byte, 1), errCh: make(chan error, 1), done: make(chan struct{})}
+	c.pending[3] = p
+
+	c.dispatchFrame(3, wsFrameCancel, nil)
+
+	select {
+	case err := <-p.errCh:
+		if err == nil {
+			t.Fatalf("dispatchFrame: expected a non-nil error for an unexpected frame type")
+		}
+	default:
+		t.Fatalf("dispatchFrame: expected an error on errCh")
+	}
+}
@@ -0,0 +1,62 @@
+package core
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"sync"
+)
+
+// MicroserviceTransport is how a microservice call is actually put on the
+// wire for a given URL scheme. Built-in transports cover http(s)://,
+// ws(s)://, grpc:// and nats://; third-party builds can register their own with
+// RegisterTransport without forking core.
+type MicroserviceTransport interface {
+	// Call sends payload to rawURL and returns the raw response body.
+	Call(ctx context.Context, rawURL string, payload []byte) ([]byte, error)
+	// Stream sends payload to rawURL and returns a channel of response
+	// chunks as they arrive, for transports/endpoints that support
+	// streaming back partial responses. The channel is closed when the
+	// stream ends; a transport that has no native streaming support may
+	// implement this by sending a single chunk then closing.
+	Stream(ctx context.Context, rawURL string, payload []byte) (<-chan []byte, error)
+}
+
+var transportRegistry = struct {
+	sync.RWMutex
+	byScheme map[string]MicroserviceTransport
+}{byScheme: map[string]MicroserviceTransport{}}
+
+// RegisterTransport registers t as the handler for scheme (without "://").
+// It is safe to call from an init() in a third-party build to add support
+// for additional endpoint schemes; registering an existing scheme replaces it.
+func RegisterTransport(scheme string, t MicroserviceTransport) {
+	transportRegistry.Lock()
+	defer transportRegistry.Unlock()
+	transportRegistry.byScheme[scheme] = t
+}
+
+// transportFor resolves rawURL's scheme to its registered MicroserviceTransport.
+func transportFor(rawURL string) (MicroserviceTransport, error) {
+	parsed, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+
+	transportRegistry.RLock()
+	t, ok := transportRegistry.byScheme[parsed.Scheme]
+	transportRegistry.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("ms %s: no transport registered for scheme %q", rawURL, parsed.Scheme)
+	}
+	return t, nil
+}
+
+func init() {
+	RegisterTransport("http", httpTransport{})
+	RegisterTransport("https", httpTransport{})
+	RegisterTransport("ws", wsTransport{})
+	RegisterTransport("wss", wsTransport{})
+	RegisterTransport("grpc", grpcTransport{})
+	RegisterTransport("nats", natsTransport{})
+}
@@ -0,0 +1,132 @@
+package core
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"strings"
+	"sync"
+
+	"github.com/nats-io/nats.go"
+)
+
+// natsTransport is the MicroserviceTransport for nats:// endpoints: the
+// subject is taken from the URL path and the call is a NATS request/reply,
+// which also makes it a natural fit for fireandforget=true hooks (plain
+// Publish, no reply wait).
+type natsTransport struct{}
+
+var natsConnPool = struct {
+	sync.Mutex
+	conns map[string]*nats.Conn
+}{conns: map[string]*nats.Conn{}}
+
+// getNatsConn returns a pooled *nats.Conn for servers, connecting if needed.
+func getNatsConn(servers string) (*nats.Conn, error) {
+	natsConnPool.Lock()
+	defer natsConnPool.Unlock()
+	if conn, ok := natsConnPool.conns[servers]; ok && !conn.IsClosed() {
+		return conn, nil
+	}
+	conn, err := nats.Connect(servers)
+	if err != nil {
+		return nil, fmt.Errorf("ms-nats %s: unable to connect. %s", servers, err.Error())
+	}
+	natsConnPool.conns[servers] = conn
+	return conn, nil
+}
+
+func (natsTransport) Call(ctx context.Context, rawURL string, payload []byte) ([]byte, error) {
+	parsed, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := getNatsConn(parsed.Host)
+	if err != nil {
+		return nil, err
+	}
+	subject := strings.TrimPrefix(parsed.Path, "/")
+
+	if parsed.Query().Get("fireandforget") == "true" {
+		if err := conn.Publish(subject, payload); err != nil {
+			return nil, fmt.Errorf("ms-nats %s: publish failed. %s", rawURL, err.Error())
+		}
+		return nil, nil
+	}
+
+	msg, err := conn.RequestWithContext(ctx, subject, payload)
+	if err != nil {
+		return nil, fmt.Errorf("ms-nats %s: request failed. %s", rawURL, err.Error())
+	}
+	return msg.Data, nil
+}
+
+// Stream subscribes to "<subject>.stream" and forwards every message until
+// the microservice publishes an empty payload to mark the end of the stream.
+func (natsTransport) Stream(ctx context.Context, rawURL string, payload []byte) (<-chan []byte, error) {
+	parsed, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := getNatsConn(parsed.Host)
+	if err != nil {
+		return nil, err
+	}
+	subject := strings.TrimPrefix(parsed.Path, "/")
+
+	ch := make(chan []byte, 16)
+	var sub *nats.Subscription
+	var mu sync.Mutex
+	closed := false
+	// stop unsubscribes and closes ch exactly once, holding mu across the
+	// whole thing. The callback below takes the same mu across its send, and
+	// its send is non-blocking (drops the frame rather than parking on a
+	// full buffer), so stop can never run concurrently with, or have to wait
+	// behind, a send that's in flight - that's what makes closing ch here
+	// safe against the send-on-closed-channel panic a bare atomic flag or an
+	// unsynchronized Unsubscribe doesn't prevent.
+	stop := func() {
+		mu.Lock()
+		defer mu.Unlock()
+		if closed {
+			return
+		}
+		closed = true
+		sub.Unsubscribe()
+		close(ch)
+	}
+	sub, err = conn.Subscribe(subject+".stream", func(m *nats.Msg) {
+		mu.Lock()
+		defer mu.Unlock()
+		if closed {
+			return
+		}
+		if len(m.Data) == 0 {
+			closed = true
+			sub.Unsubscribe()
+			close(ch)
+			return
+		}
+		select {
+		case ch <- m.Data:
+		default:
+			// consumer isn't keeping up; drop rather than block this
+			// callback (and mu, which stop() needs) indefinitely.
+		}
+	})
+	if err != nil {
+		return nil, fmt.Errorf("ms-nats %s: subscribe failed. %s", rawURL, err.Error())
+	}
+
+	if err := conn.Publish(subject, payload); err != nil {
+		sub.Unsubscribe()
+		return nil, fmt.Errorf("ms-nats %s: publish failed. %s", rawURL, err.Error())
+	}
+
+	go func() {
+		<-ctx.Done()
+		stop()
+	}()
+
+	return ch, nil
+}